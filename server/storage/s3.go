@@ -2,21 +2,160 @@ package storage
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 )
 
+// S3TransportConfig tunes the HTTP transport and retry policy used to talk
+// to S3 or an S3-compatible endpoint. A nil S3TransportConfig keeps the AWS
+// SDK's own HTTP client and retryer. A non-nil one, even the zero value,
+// replaces the SDK's HTTP client with the one httpClient builds; its zero
+// retry fields keep the SDK's retry defaults.
+type S3TransportConfig struct {
+	// RootCAs, when set, replaces the system trust store for TLS
+	// verification - needed for self-hosted MinIO/Ceph deployments behind
+	// a private CA.
+	RootCAs *x509.CertPool
+	// InsecureSkipVerify disables TLS certificate verification. Only ever
+	// use this against trusted endpoints on a private network.
+	InsecureSkipVerify bool
+
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConnsPerHost   int
+
+	// MaxRetryAttempts is the total number of attempts (including the
+	// first) the SDK's standard retryer makes before giving up. Zero keeps
+	// the SDK default.
+	MaxRetryAttempts int
+	// RetryMaxBackoff caps the exponential backoff delay between retries.
+	// Zero keeps the SDK default.
+	RetryMaxBackoff time.Duration
+}
+
+// httpClient builds the *http.Client described by cfg, or nil when cfg is
+// nil so callers fall back to the AWS SDK's default client. Any timeout
+// left at its zero value falls back to the same default net/http uses, so
+// setting e.g. only RootCAs doesn't also disable dial/handshake timeouts.
+func (cfg *S3TransportConfig) httpClient() *http.Client {
+	if cfg == nil {
+		return nil
+	}
+
+	dialTimeout := cfg.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 30 * time.Second
+	}
+	tlsHandshakeTimeout := cfg.TLSHandshakeTimeout
+	if tlsHandshakeTimeout == 0 {
+		tlsHandshakeTimeout = 10 * time.Second
+	}
+	idleConnTimeout := cfg.IdleConnTimeout
+	if idleConnTimeout == 0 {
+		idleConnTimeout = 90 * time.Second
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+	}
+
+	if cfg.RootCAs != nil || cfg.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:            cfg.RootCAs,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+		}
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// S3EncryptionConfig selects the server-side/customer-side encryption
+// S3Storage applies to objects on Put. A nil S3EncryptionConfig stores
+// objects with whatever default encryption the bucket itself enforces.
+type S3EncryptionConfig struct {
+	// SSEMode selects the server-side encryption applied to objects on Put.
+	// Supported values are "" (none), "AES256" (SSE-S3) and "aws:kms" (SSE-KMS).
+	SSEMode string
+	// KMSKeyID is the KMS key ID or alias used when SSEMode is "aws:kms".
+	// When empty, S3 encrypts with the account's default KMS key.
+	KMSKeyID string
+	// SSECustomerKey is a 256-bit key supplied by the caller for SSE-C.
+	// When set, it takes precedence over SSEMode and the same key must be
+	// supplied on every subsequent Get/Head of the object.
+	SSECustomerKey []byte
+}
+
+// S3CredentialsConfig selects how NewS3Storage obtains AWS credentials
+// beyond the static accessKey/secretKey pair. A nil S3CredentialsConfig
+// falls back to the default credential chain with no role assumption.
+type S3CredentialsConfig struct {
+	// Profile selects a named profile from the shared AWS config/credentials
+	// files. Ignored when accessKey/secretKey are set.
+	Profile string
+	// AssumeRoleARN, when set, wraps the resolved credentials in an
+	// stscreds.AssumeRoleProvider.
+	AssumeRoleARN string
+	// ExternalID is passed to sts:AssumeRole when AssumeRoleARN is set.
+	ExternalID string
+	// RoleSessionName is passed to sts:AssumeRole when AssumeRoleARN is set.
+	RoleSessionName string
+}
+
+// S3MultipartConfig tunes the multipart uploader and upload-side checksum
+// verification used by Put. A nil S3MultipartConfig keeps the AWS SDK's
+// defaults, with concurrency 20 (1 when multipart is disabled).
+type S3MultipartConfig struct {
+	// PartSize is the size in bytes of each multipart upload part. S3
+	// requires at least 5MiB per part; the zero value falls back to
+	// manager.DefaultUploadPartSize.
+	PartSize int64
+	// UploadConcurrency is the number of upload parts sent in parallel.
+	// Ignored (forced to 1) when multipart is disabled.
+	UploadConcurrency int
+	// MaxUploadParts caps the number of parts a multipart upload may use;
+	// the zero value falls back to manager.MaxUploadParts.
+	MaxUploadParts int32
+	// LeavePartsOnError keeps already-uploaded parts on S3 after a failed
+	// multipart upload instead of aborting them, so operators can inspect
+	// or resume them out of band.
+	LeavePartsOnError bool
+	// VerifyChecksum additionally sets ChecksumAlgorithm on the upload so
+	// S3 verifies part integrity on the service side.
+	VerifyChecksum bool
+}
+
 // S3Storage is a storage backed by AWS S3
 type S3Storage struct {
 	Storage
@@ -25,11 +164,31 @@ type S3Storage struct {
 	logger      *log.Logger
 	purgeDays   time.Duration
 	noMultipart bool
+
+	sseMode        string
+	kmsKeyID       string
+	sseCustomerKey []byte
+
+	partSize          int64
+	uploadConcurrency int
+	maxUploadParts    int32
+	leavePartsOnError bool
+	verifyChecksum    bool
 }
 
-// NewS3Storage is the factory for S3Storage
-func NewS3Storage(ctx context.Context, accessKey, secretKey, bucketName string, purgeDays int, region, endpoint string, disableMultipart bool, forcePathStyle bool, logger *log.Logger) (*S3Storage, error) {
-	cfg, err := getAwsConfig(ctx, accessKey, secretKey)
+// NewS3Storage is the factory for S3Storage. encryptionCfg, credentialsCfg,
+// multipartCfg and transportCfg may each be nil to take their documented
+// defaults.
+func NewS3Storage(ctx context.Context, accessKey, secretKey, bucketName string, purgeDays int, region, endpoint string, disableMultipart bool, forcePathStyle bool, logger *log.Logger, encryptionCfg *S3EncryptionConfig, credentialsCfg *S3CredentialsConfig, multipartCfg *S3MultipartConfig, transportCfg *S3TransportConfig) (*S3Storage, error) {
+	var profile, assumeRoleARN, externalID, roleSessionName string
+	if credentialsCfg != nil {
+		profile = credentialsCfg.Profile
+		assumeRoleARN = credentialsCfg.AssumeRoleARN
+		externalID = credentialsCfg.ExternalID
+		roleSessionName = credentialsCfg.RoleSessionName
+	}
+
+	cfg, err := getAwsConfig(ctx, accessKey, secretKey, region, profile, assumeRoleARN, externalID, roleSessionName, transportCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -42,15 +201,70 @@ func NewS3Storage(ctx context.Context, accessKey, secretKey, bucketName string,
 		}
 	})
 
+	var sseMode, kmsKeyID string
+	var sseCustomerKey []byte
+	if encryptionCfg != nil {
+		sseMode = encryptionCfg.SSEMode
+		kmsKeyID = encryptionCfg.KMSKeyID
+		sseCustomerKey = encryptionCfg.SSECustomerKey
+	}
+
+	var partSize int64
+	var uploadConcurrency int
+	var maxUploadParts int32
+	var leavePartsOnError, verifyChecksum bool
+	if multipartCfg != nil {
+		partSize = multipartCfg.PartSize
+		uploadConcurrency = multipartCfg.UploadConcurrency
+		maxUploadParts = multipartCfg.MaxUploadParts
+		leavePartsOnError = multipartCfg.LeavePartsOnError
+		verifyChecksum = multipartCfg.VerifyChecksum
+	}
+
+	if disableMultipart {
+		uploadConcurrency = 1
+	} else if uploadConcurrency <= 0 {
+		uploadConcurrency = 20
+	}
+
+	if partSize <= 0 {
+		partSize = manager.DefaultUploadPartSize
+	}
+	if maxUploadParts <= 0 {
+		maxUploadParts = manager.MaxUploadParts
+	}
+
 	return &S3Storage{
-		bucket:      bucketName,
-		s3:          client,
-		logger:      logger,
-		noMultipart: disableMultipart,
-		purgeDays:   time.Duration(purgeDays*24) * time.Hour,
+		bucket:            bucketName,
+		s3:                client,
+		logger:            logger,
+		noMultipart:       disableMultipart,
+		purgeDays:         time.Duration(purgeDays*24) * time.Hour,
+		sseMode:           sseMode,
+		kmsKeyID:          kmsKeyID,
+		sseCustomerKey:    sseCustomerKey,
+		partSize:          partSize,
+		uploadConcurrency: uploadConcurrency,
+		maxUploadParts:    maxUploadParts,
+		leavePartsOnError: leavePartsOnError,
+		verifyChecksum:    verifyChecksum,
 	}, nil
 }
 
+// sseCustomerHeaders derives the SSE-C algorithm/key/key-MD5 headers from
+// SSECustomerKey. It returns nil values when no customer key is configured.
+func (s *S3Storage) sseCustomerHeaders() (algorithm, key, keyMD5 *string) {
+	if len(s.sseCustomerKey) == 0 {
+		return
+	}
+
+	sum := md5.Sum(s.sseCustomerKey)
+	algorithm = aws.String("AES256")
+	key = aws.String(base64.StdEncoding.EncodeToString(s.sseCustomerKey))
+	keyMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	return
+}
+
 // Type returns the storage type
 func (s *S3Storage) Type() string {
 	return "s3"
@@ -69,12 +283,13 @@ func (s *S3Storage) Head(ctx context.Context, token string, filename string) (co
 		return
 	}
 
-	getRequest := &s3.GetObjectInput{
+	headRequest := &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(selectedKey),
 	}
+	headRequest.SSECustomerAlgorithm, headRequest.SSECustomerKey, headRequest.SSECustomerKeyMD5 = s.sseCustomerHeaders()
 
-	response, err := s.s3.GetObject(ctx, getRequest)
+	response, err := s.s3.HeadObject(ctx, headRequest)
 	if err != nil {
 		return
 	}
@@ -83,12 +298,155 @@ func (s *S3Storage) Head(ctx context.Context, token string, filename string) (co
 	return
 }
 
-// Purge cleans up the storage
-func (s *S3Storage) Purge(context.Context, time.Duration) (err error) {
-	// NOOP expiration is set at upload time
+// purgeObjectTagKey/purgeObjectTagValue mark every object Put writes as
+// managed by transfer (see Put), so the lifecycle rule and the manual sweep
+// fallback can be scoped to transfer's own objects without depending on, or
+// rewriting, the bucket's existing key layout.
+const (
+	purgeObjectTagKey   = "transfer-managed"
+	purgeObjectTagValue = "true"
+)
+
+// purgeRuleID identifies the lifecycle rule Purge installs, so repeated
+// calls update the existing rule instead of accumulating duplicates.
+const purgeRuleID = "transfer-purge"
+
+// Purge expires objects older than retention (or S3Storage.purgeDays when
+// retention is zero) by installing an S3 bucket lifecycle rule. Relying on
+// PutObjectInput.Expires does nothing on most S3-compatible services
+// (MinIO, Ceph, GCS' S3 interop, ...), so the object's actual age has to be
+// enforced by the bucket itself. When the bucket rejects lifecycle writes
+// (e.g. a restrictive IAM policy), Purge falls back to a paginated
+// ListObjectsV2 + DeleteObjects sweep keyed on LastModified.
+func (s *S3Storage) Purge(ctx context.Context, retention time.Duration) (err error) {
+	if retention <= 0 {
+		retention = s.purgeDays
+	}
+	if retention <= 0 {
+		return nil
+	}
+	days := int32(retention.Hours() / 24)
+	if days < 1 {
+		days = 1
+	}
+
+	_, err = s.s3.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(s.bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{
+			Rules: []types.LifecycleRule{
+				{
+					ID:     aws.String(purgeRuleID),
+					Status: types.ExpirationStatusEnabled,
+					Filter: &types.LifecycleRuleFilterMemberTag{
+						Value: types.Tag{
+							Key:   aws.String(purgeObjectTagKey),
+							Value: aws.String(purgeObjectTagValue),
+						},
+					},
+					Expiration: &types.LifecycleExpiration{
+						Days: aws.Int32(days),
+					},
+				},
+			},
+		},
+	})
+	if err == nil {
+		return nil
+	}
+	if !isLifecycleUnsupported(err) {
+		return err
+	}
+
+	s.logger.Printf("S3 lifecycle configuration rejected by bucket %s, falling back to manual purge sweep: %v", s.bucket, err)
+	return s.purgeSweep(ctx, retention)
+}
+
+// isLifecycleUnsupported reports whether err indicates the bucket/endpoint
+// rejects or doesn't support PutBucketLifecycleConfiguration (a restrictive
+// IAM policy, or an S3-compatible service with no lifecycle support) as
+// opposed to a transient network or throttling error, which should be
+// surfaced rather than triggering the destructive purgeSweep fallback.
+func isLifecycleUnsupported(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	switch apiErr.ErrorCode() {
+	case "AccessDenied", "AccessDeniedException", "NotImplemented", "MethodNotAllowed", "UnsupportedOperation":
+		return true
+	default:
+		return false
+	}
+}
+
+// purgeSweep deletes objects tagged purgeObjectTagKey=purgeObjectTagValue
+// whose LastModified is older than retention. It is the fallback used when
+// the bucket doesn't allow PutBucketLifecycleConfiguration.
+func (s *S3Storage) purgeSweep(ctx context.Context, retention time.Duration) (err error) {
+	cutoff := time.Now().Add(-retention)
+
+	paginator := s3.NewListObjectsV2Paginator(s.s3, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	})
+
+	for paginator.HasMorePages() {
+		page, pageErr := paginator.NextPage(ctx)
+		if pageErr != nil {
+			return pageErr
+		}
+
+		var stale []types.ObjectIdentifier
+		for _, item := range page.Contents {
+			if item.LastModified == nil || !item.LastModified.Before(cutoff) {
+				continue
+			}
+
+			managed, tagErr := s.isTransferManaged(ctx, *item.Key)
+			if tagErr != nil {
+				return tagErr
+			}
+			if managed {
+				stale = append(stale, types.ObjectIdentifier{Key: item.Key})
+			}
+		}
+
+		if len(stale) == 0 {
+			continue
+		}
+
+		_, err = s.s3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: stale},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// isTransferManaged reports whether key carries the tag Put attaches to
+// every object transfer writes, so purgeSweep never deletes an unrelated
+// object that happens to share the bucket.
+func (s *S3Storage) isTransferManaged(ctx context.Context, key string) (bool, error) {
+	tagging, err := s.s3.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, tag := range tagging.TagSet {
+		if aws.ToString(tag.Key) == purgeObjectTagKey && aws.ToString(tag.Value) == purgeObjectTagValue {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // IsNotExist indicates if a file doesn't exist on storage
 func (s *S3Storage) IsNotExist(err error) bool {
 	if err == nil {
@@ -96,7 +454,12 @@ func (s *S3Storage) IsNotExist(err error) bool {
 	}
 
 	var nkerr *types.NoSuchKey
-	return errors.As(err, &nkerr)
+	if errors.As(err, &nkerr) {
+		return true
+	}
+
+	var nferr *types.NotFound
+	return errors.As(err, &nferr)
 }
 
 // Get retrieves a file from storage
@@ -116,6 +479,10 @@ func (s *S3Storage) Get(ctx context.Context, token string, filename string, rng
 		Bucket: aws.String(s.bucket),
 		Key:    aws.String(selectedKey),
 	}
+	getRequest.SSECustomerAlgorithm, getRequest.SSECustomerKey, getRequest.SSECustomerKeyMD5 = s.sseCustomerHeaders()
+	if rng != nil {
+		getRequest.Range = aws.String(fmt.Sprintf("bytes=%d-%d", rng.Start, rng.End))
+	}
 
 	response, err := s.s3.GetObject(ctx, getRequest)
 	if err != nil {
@@ -131,13 +498,55 @@ func (s *S3Storage) Get(ctx context.Context, token string, filename string, rng
 	return
 }
 
+// getFileName resolves the S3 key for a token's object. When metadataFlag
+// names a file (including the ".metadata" sentinel), it first tries the
+// deterministic key token/<metadataFlag> with a single HeadObject instead of
+// an O(N) ListObjectsV2 over the token's prefix. A caller isn't guaranteed
+// to pass the exact stored content filename though, so a miss on that
+// HeadObject (other than for the ".metadata" sentinel, whose key is always
+// written verbatim) falls back to the same prefix-scan listContentFile uses
+// when metadataFlag is empty.
 func (s *S3Storage) getFileName(ctx context.Context, metadataFlag, bucket, token string) (fileName, selectedKey string, err error) {
 
-	key := fmt.Sprintf("%s/", token)
+	if metadataFlag != "" {
+		key := fmt.Sprintf("%s/%s", token, metadataFlag)
+
+		headRequest := &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}
+		headRequest.SSECustomerAlgorithm, headRequest.SSECustomerKey, headRequest.SSECustomerKeyMD5 = s.sseCustomerHeaders()
+
+		_, err = s.s3.HeadObject(ctx, headRequest)
+		if err == nil {
+			selectedKey = key
+			if metadataFlag != ".metadata" {
+				fileName = metadataFlag
+			}
+			return
+		}
+		if !s.IsNotExist(err) {
+			return
+		}
+		err = nil
+
+		if metadataFlag == ".metadata" {
+			return
+		}
+	}
+
+	return s.listContentFile(ctx, bucket, token)
+}
+
+// listContentFile finds the token's content object by listing its prefix.
+// It is used only when the caller doesn't know the stored filename.
+func (s *S3Storage) listContentFile(ctx context.Context, bucket, token string) (fileName, selectedKey string, err error) {
+
+	prefix := fmt.Sprintf("%s/", token)
 
 	listInput := &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
-		Prefix: aws.String(key),
+		Prefix: aws.String(prefix),
 	}
 
 	result, err := s.s3.ListObjectsV2(ctx, listInput)
@@ -147,14 +556,10 @@ func (s *S3Storage) getFileName(ctx context.Context, metadataFlag, bucket, token
 
 	for _, item := range result.Contents {
 		itemkey := *item.Key
-		if metadataFlag == ".metadata" && strings.HasSuffix(itemkey, ".metadata") {
-			selectedKey = itemkey
-			break
-		} else if metadataFlag != ".metadata" && !strings.HasSuffix(itemkey, ".metadata") {
+		if !strings.HasSuffix(itemkey, ".metadata") {
 			selectedKey = itemkey
 			parts := strings.Split(itemkey, "/")
-			name := parts[len(parts)-1]
-			fileName = name
+			fileName = parts[len(parts)-1]
 			break
 		}
 	}
@@ -196,21 +601,17 @@ func (s *S3Storage) Delete(ctx context.Context, token string) (err error) {
 }
 
 // Put saves a file on storage
-func (s *S3Storage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, _ uint64) (err error) {
+func (s *S3Storage) Put(ctx context.Context, token string, filename string, reader io.Reader, contentType string, size uint64) (err error) {
 	key := fmt.Sprintf("%s/%s", token, filename)
 
 	s.logger.Printf("Uploading file %s to S3 Bucket", filename)
-	var concurrency int
-	if !s.noMultipart {
-		concurrency = 20
-	} else {
-		concurrency = 1
-	}
 
 	// Create an uploader with the session and custom options
 	uploader := manager.NewUploader(s.s3, func(u *manager.Uploader) {
-		u.Concurrency = concurrency // default is 5
-		u.LeavePartsOnError = false
+		u.Concurrency = s.uploadConcurrency // default is 5
+		u.PartSize = s.partSize
+		u.MaxUploadParts = s.maxUploadParts
+		u.LeavePartsOnError = s.leavePartsOnError
 	})
 
 	var expire *time.Time
@@ -218,27 +619,236 @@ func (s *S3Storage) Put(ctx context.Context, token string, filename string, read
 		expire = aws.Time(time.Now().Add(s.purgeDays))
 	}
 
-	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
+	hasher := sha256.New()
+
+	putInput := &s3.PutObjectInput{
 		Bucket:      aws.String(s.bucket),
 		Key:         aws.String(key),
-		Body:        reader,
+		Body:        io.TeeReader(reader, hasher),
 		Expires:     expire,
 		ContentType: aws.String(contentType),
-	})
+		Tagging:     aws.String(fmt.Sprintf("%s=%s", purgeObjectTagKey, purgeObjectTagValue)),
+	}
+
+	if s.verifyChecksum {
+		putInput.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
 
+	if len(s.sseCustomerKey) > 0 {
+		putInput.SSECustomerAlgorithm, putInput.SSECustomerKey, putInput.SSECustomerKeyMD5 = s.sseCustomerHeaders()
+	} else if s.sseMode != "" {
+		putInput.ServerSideEncryption = types.ServerSideEncryption(s.sseMode)
+		if s.sseMode == string(types.ServerSideEncryptionAwsKms) && s.kmsKeyID != "" {
+			putInput.SSEKMSKeyId = aws.String(s.kmsKeyID)
+		}
+	}
+
+	if _, err = uploader.Upload(ctx, putInput); err != nil {
+		return
+	}
+
+	return s.storeChecksumMetadata(ctx, key, contentType, hex.EncodeToString(hasher.Sum(nil)), size)
+}
+
+// copyObjectMaxBytes is S3's hard limit on the size of a CopyObject source
+// object; anything larger must be copied with UploadPartCopy instead.
+const copyObjectMaxBytes = 5 * 1024 * 1024 * 1024 // 5 GiB
+
+// storeChecksumMetadata records the object's full-content SHA-256 as
+// "x-amz-meta-sha256" so it can be used for end-to-end integrity
+// verification later. The hash is only known once the whole body has
+// streamed through the uploader, so it's applied with a self-copy
+// (MetadataDirective=REPLACE) rather than at the initial Put. Sources over
+// copyObjectMaxBytes are re-copied with UploadPartCopy, since CopyObject
+// rejects them outright.
+func (s *S3Storage) storeChecksumMetadata(ctx context.Context, key, contentType, sha256Hex string, size uint64) (err error) {
+	copySource := s.copySource(key)
+
+	if size > copyObjectMaxBytes {
+		return s.storeChecksumMetadataMultipart(ctx, key, contentType, sha256Hex, copySource, size)
+	}
+
+	copyInput := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(copySource),
+		ContentType:       aws.String(contentType),
+		Metadata:          map[string]string{"sha256": sha256Hex},
+		MetadataDirective: types.MetadataDirectiveReplace,
+	}
+
+	if len(s.sseCustomerKey) > 0 {
+		algorithm, sseKey, keyMD5 := s.sseCustomerHeaders()
+		copyInput.SSECustomerAlgorithm, copyInput.SSECustomerKey, copyInput.SSECustomerKeyMD5 = algorithm, sseKey, keyMD5
+		copyInput.CopySourceSSECustomerAlgorithm, copyInput.CopySourceSSECustomerKey, copyInput.CopySourceSSECustomerKeyMD5 = algorithm, sseKey, keyMD5
+	} else if s.sseMode != "" {
+		copyInput.ServerSideEncryption = types.ServerSideEncryption(s.sseMode)
+		if s.sseMode == string(types.ServerSideEncryptionAwsKms) && s.kmsKeyID != "" {
+			copyInput.SSEKMSKeyId = aws.String(s.kmsKeyID)
+		}
+	}
+
+	_, err = s.s3.CopyObject(ctx, copyInput)
 	return
 }
 
+// copySource builds the URI-encoded "bucket/key" value S3's CopySource
+// header requires. Unescaped spaces, '%', '+', '#' or non-ASCII bytes in
+// key would otherwise produce an invalid or silently wrong copy source.
+func (s *S3Storage) copySource(key string) string {
+	// EscapedPath leaves '+' as is, since it is legal in a URL path.
+	return strings.ReplaceAll((&url.URL{Path: s.bucket + "/" + key}).EscapedPath(), "+", "%2B")
+}
+
+// storeChecksumMetadataMultipart re-applies the checksum metadata via
+// CreateMultipartUpload + UploadPartCopy + CompleteMultipartUpload, the only
+// path S3 supports for copying a source object over copyObjectMaxBytes.
+func (s *S3Storage) storeChecksumMetadataMultipart(ctx context.Context, key, contentType, sha256Hex, copySource string, size uint64) (err error) {
+	createInput := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+		Metadata:    map[string]string{"sha256": sha256Hex},
+		Tagging:     aws.String(fmt.Sprintf("%s=%s", purgeObjectTagKey, purgeObjectTagValue)),
+	}
+
+	if len(s.sseCustomerKey) > 0 {
+		createInput.SSECustomerAlgorithm, createInput.SSECustomerKey, createInput.SSECustomerKeyMD5 = s.sseCustomerHeaders()
+	} else if s.sseMode != "" {
+		createInput.ServerSideEncryption = types.ServerSideEncryption(s.sseMode)
+		if s.sseMode == string(types.ServerSideEncryptionAwsKms) && s.kmsKeyID != "" {
+			createInput.SSEKMSKeyId = aws.String(s.kmsKeyID)
+		}
+	}
+
+	created, err := s.s3.CreateMultipartUpload(ctx, createInput)
+	if err != nil {
+		return err
+	}
+
+	partSize := s.partSize
+	if partSize <= 0 {
+		partSize = manager.DefaultUploadPartSize
+	}
+
+	var parts []types.CompletedPart
+	for partNumber, start := int32(1), uint64(0); start < size; partNumber, start = partNumber+1, start+uint64(partSize) {
+		end := start + uint64(partSize) - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		uploadPartCopyInput := &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			UploadId:        created.UploadId,
+			PartNumber:      aws.Int32(partNumber),
+			CopySource:      aws.String(copySource),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		}
+		if len(s.sseCustomerKey) > 0 {
+			algorithm, sseKey, keyMD5 := s.sseCustomerHeaders()
+			uploadPartCopyInput.SSECustomerAlgorithm, uploadPartCopyInput.SSECustomerKey, uploadPartCopyInput.SSECustomerKeyMD5 = algorithm, sseKey, keyMD5
+			uploadPartCopyInput.CopySourceSSECustomerAlgorithm, uploadPartCopyInput.CopySourceSSECustomerKey, uploadPartCopyInput.CopySourceSSECustomerKeyMD5 = algorithm, sseKey, keyMD5
+		}
+
+		partResult, partErr := s.s3.UploadPartCopy(ctx, uploadPartCopyInput)
+		if partErr != nil {
+			s.abortMultipartChecksumCopy(ctx, key, created.UploadId)
+			return partErr
+		}
+
+		parts = append(parts, types.CompletedPart{
+			ETag:       partResult.CopyPartResult.ETag,
+			PartNumber: aws.Int32(partNumber),
+		})
+	}
+
+	if _, err = s.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		s.abortMultipartChecksumCopy(ctx, key, created.UploadId)
+	}
+	return err
+}
+
+// abortMultipartChecksumCopy best-effort aborts a multipart checksum copy
+// left incomplete by a failed UploadPartCopy or CompleteMultipartUpload. It
+// logs rather than returns the abort error since the original failure is
+// what the caller needs to see.
+func (s *S3Storage) abortMultipartChecksumCopy(ctx context.Context, key string, uploadID *string) {
+	if _, abortErr := s.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	}); abortErr != nil {
+		s.logger.Printf("failed to abort multipart checksum copy for %s: %v", key, abortErr)
+	}
+}
+
 func (s *S3Storage) IsRangeSupported() bool { return true }
 
-func getAwsConfig(ctx context.Context, accessKey, secretKey string) (aws.Config, error) {
-	return config.LoadDefaultConfig(ctx,
-		config.WithCredentialsProvider(credentials.StaticCredentialsProvider{
+// getAwsConfig builds the AWS config used by the S3 client. When accessKey
+// and secretKey are both empty it falls back to the default credential
+// chain (environment, shared config/profile, EC2 instance metadata, and
+// ECS/EKS IRSA via STS AssumeRoleWithWebIdentity) so transfer can run with
+// no static keys baked into configuration. When assumeRoleARN is set, the
+// resolved credentials are wrapped in an stscreds.AssumeRoleProvider.
+func getAwsConfig(ctx context.Context, accessKey, secretKey, region, profile, assumeRoleARN, externalID, roleSessionName string, transportCfg *S3TransportConfig) (aws.Config, error) {
+	opts := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+	}
+
+	if accessKey != "" || secretKey != "" {
+		opts = append(opts, config.WithCredentialsProvider(credentials.StaticCredentialsProvider{
 			Value: aws.Credentials{
 				AccessKeyID:     accessKey,
 				SecretAccessKey: secretKey,
 				SessionToken:    "",
 			},
-		}),
-	)
+		}))
+	} else if profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+
+	if httpClient := transportCfg.httpClient(); httpClient != nil {
+		opts = append(opts, config.WithHTTPClient(httpClient))
+	}
+
+	if transportCfg != nil && (transportCfg.MaxRetryAttempts > 0 || transportCfg.RetryMaxBackoff > 0) {
+		opts = append(opts, config.WithRetryer(func() aws.Retryer {
+			standard := retry.NewStandard(func(o *retry.StandardOptions) {
+				if transportCfg.MaxRetryAttempts > 0 {
+					o.MaxAttempts = transportCfg.MaxRetryAttempts
+				}
+				if transportCfg.RetryMaxBackoff > 0 {
+					o.MaxBackoff = transportCfg.RetryMaxBackoff
+				}
+			})
+			return standard
+		}))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return cfg, err
+	}
+
+	if assumeRoleARN != "" {
+		stsClient := sts.NewFromConfig(cfg)
+		provider := stscreds.NewAssumeRoleProvider(stsClient, assumeRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			if externalID != "" {
+				o.ExternalID = aws.String(externalID)
+			}
+			if roleSessionName != "" {
+				o.RoleSessionName = roleSessionName
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+
+	return cfg, nil
 }